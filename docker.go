@@ -0,0 +1,96 @@
+/*
+Copyright 2018 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+
+	"github.com/docker/cli/cli/command"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	registrytypes "github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/registry"
+	"github.com/pkg/errors"
+)
+
+// DockerClient abstracts the subset of the Docker API that Swarm needs, so
+// it can be mocked in tests.
+type DockerClient interface {
+	ServiceList(ctx context.Context, options types.ServiceListOptions) ([]swarm.Service, error)
+	ServiceUpdate(ctx context.Context, serviceID string, version swarm.Version, service swarm.ServiceSpec, options types.ServiceUpdateOptions) (types.ServiceUpdateResponse, error)
+	ServiceInspectWithRaw(ctx context.Context, serviceID string, options types.ServiceInspectOptions) (swarm.Service, []byte, error)
+	DistributionInspect(ctx context.Context, image, encodedRegistryAuth string) (registrytypes.DistributionInspect, error)
+	RetrieveAuthTokenFromImage(ctx context.Context, image string) (string, error)
+	Info(ctx context.Context) (types.Info, error)
+	TaskList(ctx context.Context, options types.TaskListOptions) ([]swarm.Task, error)
+}
+
+// dockerClient implements DockerClient on top of the real Docker API client
+// and the docker CLI's own config/credential store.
+type dockerClient struct {
+	apiClient client.APIClient
+	dockerCli command.Cli
+}
+
+func (d *dockerClient) ServiceList(ctx context.Context, options types.ServiceListOptions) ([]swarm.Service, error) {
+	return d.apiClient.ServiceList(ctx, options)
+}
+
+func (d *dockerClient) ServiceUpdate(ctx context.Context, serviceID string, version swarm.Version, service swarm.ServiceSpec, options types.ServiceUpdateOptions) (types.ServiceUpdateResponse, error) {
+	return d.apiClient.ServiceUpdate(ctx, serviceID, version, service, options)
+}
+
+func (d *dockerClient) ServiceInspectWithRaw(ctx context.Context, serviceID string, options types.ServiceInspectOptions) (swarm.Service, []byte, error) {
+	return d.apiClient.ServiceInspectWithRaw(ctx, serviceID, options)
+}
+
+func (d *dockerClient) DistributionInspect(ctx context.Context, image, encodedRegistryAuth string) (registrytypes.DistributionInspect, error) {
+	return d.apiClient.DistributionInspect(ctx, image, encodedRegistryAuth)
+}
+
+func (d *dockerClient) RetrieveAuthTokenFromImage(ctx context.Context, image string) (string, error) {
+	namedRef, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to parse image name")
+	}
+
+	repoInfo, err := registry.ParseRepositoryInfo(namedRef)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to parse repository info")
+	}
+
+	authConfig := command.ResolveAuthConfig(d.dockerCli, repoInfo.Index)
+
+	encodedAuth, err := command.EncodeAuthToBase64(authConfig)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to encode auth config")
+	}
+
+	return encodedAuth, nil
+}
+
+// Info returns the local daemon's system information, used to default a
+// service's platform constraints when it doesn't declare its own.
+func (d *dockerClient) Info(ctx context.Context) (types.Info, error) {
+	return d.apiClient.Info(ctx)
+}
+
+func (d *dockerClient) TaskList(ctx context.Context, options types.TaskListOptions) ([]swarm.Task, error) {
+	return d.apiClient.TaskList(ctx, options)
+}
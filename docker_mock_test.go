@@ -0,0 +1,99 @@
+/*
+Copyright 2018 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/docker/docker/api/types"
+	registrytypes "github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/api/types/swarm"
+)
+
+// fakeDockerClient is a minimal, fully in-memory DockerClient so Swarm's
+// branching logic can be exercised in tests without a real docker daemon.
+type fakeDockerClient struct {
+	serviceList    []swarm.Service
+	serviceListErr error
+
+	serviceUpdateResponse types.ServiceUpdateResponse
+	serviceUpdateErr      error
+
+	serviceInspect    swarm.Service
+	serviceInspectErr error
+
+	distributionInspect    registrytypes.DistributionInspect
+	distributionInspectErr error
+
+	retrieveAuthToken string
+	retrieveAuthErr   error
+
+	info    types.Info
+	infoErr error
+
+	taskList    []swarm.Task
+	taskListErr error
+
+	mu                 sync.Mutex
+	serviceUpdateCalls int
+	lastUpdateOpts     types.ServiceUpdateOptions
+}
+
+func (f *fakeDockerClient) ServiceList(ctx context.Context, options types.ServiceListOptions) ([]swarm.Service, error) {
+	return f.serviceList, f.serviceListErr
+}
+
+func (f *fakeDockerClient) ServiceUpdate(ctx context.Context, serviceID string, version swarm.Version, service swarm.ServiceSpec, options types.ServiceUpdateOptions) (types.ServiceUpdateResponse, error) {
+	f.mu.Lock()
+	f.serviceUpdateCalls++
+	f.lastUpdateOpts = options
+	f.mu.Unlock()
+	return f.serviceUpdateResponse, f.serviceUpdateErr
+}
+
+func (f *fakeDockerClient) ServiceInspectWithRaw(ctx context.Context, serviceID string, options types.ServiceInspectOptions) (swarm.Service, []byte, error) {
+	return f.serviceInspect, nil, f.serviceInspectErr
+}
+
+func (f *fakeDockerClient) DistributionInspect(ctx context.Context, image, encodedRegistryAuth string) (registrytypes.DistributionInspect, error) {
+	return f.distributionInspect, f.distributionInspectErr
+}
+
+func (f *fakeDockerClient) RetrieveAuthTokenFromImage(ctx context.Context, image string) (string, error) {
+	return f.retrieveAuthToken, f.retrieveAuthErr
+}
+
+func (f *fakeDockerClient) Info(ctx context.Context) (types.Info, error) {
+	return f.info, f.infoErr
+}
+
+func (f *fakeDockerClient) TaskList(ctx context.Context, options types.TaskListOptions) ([]swarm.Task, error) {
+	return f.taskList, f.taskListErr
+}
+
+func (f *fakeDockerClient) updateCalls() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.serviceUpdateCalls
+}
+
+func (f *fakeDockerClient) lastOpts() types.ServiceUpdateOptions {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.lastUpdateOpts
+}
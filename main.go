@@ -0,0 +1,102 @@
+/*
+Copyright 2018 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"megpoid.xyz/go/swarm-updater/log"
+	"megpoid.xyz/go/swarm-updater/registry"
+)
+
+func main() {
+	var (
+		blacklist             = flag.String("blacklist", "", "comma-separated list of regexes matching service names to skip")
+		labelEnable           = flag.Bool("label-enable", false, "only update services with the "+enabledServiceLabel+" label set to true")
+		allowPlatformMismatch = flag.Bool("allow-platform-mismatch", false, "pin a manifest-list digest even when no platform in it matches the service's placement constraints")
+		pinMode               = flag.String("pin-mode", string(PinModeClient), "how to pin image digests: client, daemon, or off")
+		failOnPinWarning      = flag.Bool("fail-on-pin-warning", false, "treat a daemon \"unable to pin\" warning as an update failure (only applies to pin-mode=daemon)")
+		convergeTimeout       = flag.Duration("converge-timeout", DefaultConvergeTimeout, "how long to wait for an updated service to converge before rolling it back")
+		registryAuthFile      = flag.String("registry-auth-file", "", "path to a registry auth config file (see the registry package); registry credentials fall back to the docker CLI's own config when unset")
+		registryAuthTTL       = flag.Duration("registry-auth-ttl", 15*time.Minute, "how long to cache credentials resolved from -registry-auth-file")
+		maxParallel           = flag.Int("max-parallel", defaultMaxParallel, "maximum number of services to update concurrently")
+	)
+
+	flag.Parse()
+
+	swarm, err := NewSwarm()
+	if err != nil {
+		log.Printf("%s", err)
+		os.Exit(1)
+	}
+
+	swarm.LabelEnable = *labelEnable
+	swarm.AllowPlatformMismatch = *allowPlatformMismatch
+	swarm.PinMode = PinMode(*pinMode)
+	swarm.FailOnPinWarning = *failOnPinWarning
+	swarm.ConvergeTimeout = *convergeTimeout
+	swarm.MaxParallel = *maxParallel
+
+	if *registryAuthFile != "" {
+		resolver, err := registry.NewResolver(*registryAuthFile, *registryAuthTTL)
+		if err != nil {
+			log.Printf("%s", err)
+			os.Exit(1)
+		}
+		swarm.Registry = resolver
+	}
+
+	if *blacklist != "" {
+		for _, pattern := range strings.Split(*blacklist, ",") {
+			re, err := regexp.Compile(strings.TrimSpace(pattern))
+			if err != nil {
+				log.Printf("invalid blacklist pattern %q: %s", pattern, err)
+				os.Exit(1)
+			}
+			swarm.Blacklist = append(swarm.Blacklist, re)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		cancel()
+	}()
+
+	report, err := swarm.UpdateServices(ctx)
+	if err != nil {
+		log.Printf("%s", err)
+		os.Exit(1)
+	}
+
+	for _, result := range report.Results {
+		if result.Outcome == OutcomeFailed {
+			os.Exit(1)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+/*
+Copyright 2018 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package registry resolves registry credentials from a config file instead
+// of relying on the invoking daemon's own docker login session, so the
+// updater works against registries (ECR, GCR/Artifact Registry, Harbor, ...)
+// that the daemon itself has no credentials for.
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/cli/cli/command"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/pkg/errors"
+)
+
+// Entry describes how to authenticate against a single registry host.
+type Entry struct {
+	Username         string `json:"username,omitempty"`
+	Password         string `json:"password,omitempty"`
+	Token            string `json:"token,omitempty"`
+	CredentialHelper string `json:"credentialHelper,omitempty"`
+}
+
+// Config maps registry hostnames to the credentials to use for them.
+type Config struct {
+	Registries map[string]Entry `json:"registries"`
+}
+
+// LoadConfig reads and parses a registry auth config file.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read registry auth file %s", path)
+	}
+
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse registry auth file %s", path)
+	}
+
+	return &config, nil
+}
+
+// Host returns the registry hostname a given image reference belongs to.
+func Host(image string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to parse image name")
+	}
+
+	return reference.Domain(named), nil
+}
+
+type cacheEntry struct {
+	encodedAuth string
+	expires     time.Time
+}
+
+// Resolver resolves and caches base64-encoded registry auth for images,
+// consulting Config before falling back to the caller's own lookup.
+type Resolver struct {
+	config *Config
+	ttl    time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cacheEntry
+}
+
+// NewResolver loads the config file at path and returns a Resolver that
+// caches resolved credentials for the given TTL.
+func NewResolver(path string, ttl time.Duration) (*Resolver, error) {
+	config, err := LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Resolver{
+		config: config,
+		ttl:    ttl,
+		cache:  make(map[string]cacheEntry),
+	}, nil
+}
+
+// AuthForImage returns the base64-encoded AuthConfig to use for image's
+// registry, per the docker credential-helper protocol. It returns an error
+// if the registry isn't present in the resolver's config, so callers can
+// fall back to another auth source.
+func (r *Resolver) AuthForImage(ctx context.Context, image string) (string, error) {
+	host, err := Host(image)
+	if err != nil {
+		return "", err
+	}
+
+	r.mu.Lock()
+	if cached, ok := r.cache[host]; ok && time.Now().Before(cached.expires) {
+		r.mu.Unlock()
+		return cached.encodedAuth, nil
+	}
+	r.mu.Unlock()
+
+	entry, ok := r.config.Registries[host]
+	if !ok {
+		return "", errors.Errorf("no registry auth configured for %s", host)
+	}
+
+	authConfig, err := r.resolveEntry(ctx, host, entry)
+	if err != nil {
+		return "", err
+	}
+
+	encodedAuth, err := command.EncodeAuthToBase64(authConfig)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to encode auth for %s", host)
+	}
+
+	r.mu.Lock()
+	r.cache[host] = cacheEntry{encodedAuth: encodedAuth, expires: time.Now().Add(r.ttl)}
+	r.mu.Unlock()
+
+	return encodedAuth, nil
+}
+
+// Invalidate drops any cached credentials for host, forcing the next
+// AuthForImage call to resolve them again. Callers should invoke this after
+// a 401 from the registry.
+func (r *Resolver) Invalidate(host string) {
+	r.mu.Lock()
+	delete(r.cache, host)
+	r.mu.Unlock()
+}
+
+func (r *Resolver) resolveEntry(ctx context.Context, host string, entry Entry) (types.AuthConfig, error) {
+	if entry.CredentialHelper != "" {
+		return credentialHelperAuth(ctx, host, entry.CredentialHelper)
+	}
+
+	if entry.Token != "" {
+		return types.AuthConfig{RegistryToken: entry.Token, ServerAddress: host}, nil
+	}
+
+	if entry.Username != "" {
+		return types.AuthConfig{Username: entry.Username, Password: entry.Password, ServerAddress: host}, nil
+	}
+
+	return types.AuthConfig{}, errors.Errorf("registry auth entry for %s has none of credentialHelper, token, or username set", host)
+}
+
+// credentialHelperAuth shells out to docker-credential-<name> the same way
+// the docker CLI does: the registry hostname is written to stdin of the
+// "get" command, and a JSON document with ServerURL/Username/Secret is read
+// back from stdout.
+func credentialHelperAuth(ctx context.Context, host, helper string) (types.AuthConfig, error) {
+	cmd := exec.CommandContext(ctx, "docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(host)
+
+	out, err := cmd.Output()
+	if err != nil {
+		return types.AuthConfig{}, errors.Wrapf(err, "docker-credential-%s get %s failed", helper, host)
+	}
+
+	var resp struct {
+		ServerURL string
+		Username  string
+		Secret    string
+	}
+
+	if err := json.Unmarshal(out, &resp); err != nil {
+		return types.AuthConfig{}, errors.Wrapf(err, "failed to parse docker-credential-%s output", helper)
+	}
+
+	return types.AuthConfig{Username: resp.Username, Password: resp.Secret, ServerAddress: host}, nil
+}
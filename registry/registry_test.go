@@ -0,0 +1,167 @@
+/*
+Copyright 2018 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHost(t *testing.T) {
+	cases := []struct {
+		name    string
+		image   string
+		want    string
+		wantErr bool
+	}{
+		{name: "docker hub, implicit", image: "nginx:latest", want: "docker.io"},
+		{name: "custom registry", image: "myregistry.example.com/app:1.0", want: "myregistry.example.com"},
+		{name: "custom registry with port", image: "myregistry.example.com:5000/app:1.0", want: "myregistry.example.com:5000"},
+		{name: "invalid image name", image: "In Valid::Name", wantErr: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := Host(tc.image)
+
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("Host(%q) expected an error, got nil", tc.image)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Host(%q) unexpected error: %s", tc.image, err)
+			}
+
+			if got != tc.want {
+				t.Errorf("Host(%q) = %q, want %q", tc.image, got, tc.want)
+			}
+		})
+	}
+}
+
+func writeConfig(t *testing.T, config Config) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "registry-auth.json")
+
+	data, err := json.Marshal(config)
+	if err != nil {
+		t.Fatalf("failed to marshal config: %s", err)
+	}
+
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("failed to write config: %s", err)
+	}
+
+	return path
+}
+
+func TestResolverAuthForImageCachesResult(t *testing.T) {
+	path := writeConfig(t, Config{Registries: map[string]Entry{
+		"myregistry.example.com": {Username: "user", Password: "pass"},
+	}})
+
+	resolver, err := NewResolver(path, time.Minute)
+	if err != nil {
+		t.Fatalf("NewResolver() error: %s", err)
+	}
+
+	ctx := context.Background()
+
+	auth, err := resolver.AuthForImage(ctx, "myregistry.example.com/app:1.0")
+	if err != nil {
+		t.Fatalf("AuthForImage() error: %s", err)
+	}
+
+	if auth == "" {
+		t.Fatal("AuthForImage() returned an empty auth string")
+	}
+
+	// a different image on the same registry must hit the cache
+	cached, err := resolver.AuthForImage(ctx, "myregistry.example.com/other:2.0")
+	if err != nil {
+		t.Fatalf("AuthForImage() (cached) error: %s", err)
+	}
+
+	if cached != auth {
+		t.Errorf("AuthForImage() cached = %q, want %q", cached, auth)
+	}
+
+	resolver.Invalidate("myregistry.example.com")
+
+	resolver.mu.Lock()
+	_, cachedAfterInvalidate := resolver.cache["myregistry.example.com"]
+	resolver.mu.Unlock()
+
+	if cachedAfterInvalidate {
+		t.Error("Invalidate() did not remove the cached entry")
+	}
+}
+
+func TestResolverUnknownRegistry(t *testing.T) {
+	path := writeConfig(t, Config{Registries: map[string]Entry{}})
+
+	resolver, err := NewResolver(path, time.Minute)
+	if err != nil {
+		t.Fatalf("NewResolver() error: %s", err)
+	}
+
+	if _, err := resolver.AuthForImage(context.Background(), "unknown.example.com/app:1.0"); err == nil {
+		t.Fatal("AuthForImage() expected an error for an unconfigured registry")
+	}
+}
+
+func TestResolverExpiredCacheEntryIsRefreshed(t *testing.T) {
+	path := writeConfig(t, Config{Registries: map[string]Entry{
+		"myregistry.example.com": {Username: "user", Password: "pass"},
+	}})
+
+	resolver, err := NewResolver(path, time.Minute)
+	if err != nil {
+		t.Fatalf("NewResolver() error: %s", err)
+	}
+
+	ctx := context.Background()
+
+	if _, err := resolver.AuthForImage(ctx, "myregistry.example.com/app:1.0"); err != nil {
+		t.Fatalf("AuthForImage() error: %s", err)
+	}
+
+	// force the cached entry to look expired
+	resolver.mu.Lock()
+	resolver.cache["myregistry.example.com"] = cacheEntry{
+		encodedAuth: "stale",
+		expires:     time.Now().Add(-time.Second),
+	}
+	resolver.mu.Unlock()
+
+	refreshed, err := resolver.AuthForImage(ctx, "myregistry.example.com/app:1.0")
+	if err != nil {
+		t.Fatalf("AuthForImage() error: %s", err)
+	}
+
+	if refreshed == "stale" {
+		t.Error("AuthForImage() returned an expired cache entry instead of refreshing it")
+	}
+}
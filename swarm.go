@@ -20,26 +20,136 @@ import (
 	"context"
 	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/docker/cli/cli/command"
 	"github.com/docker/cli/cli/flags"
 	"github.com/docker/distribution/reference"
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/swarm"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"megpoid.xyz/go/swarm-updater/log"
+	"megpoid.xyz/go/swarm-updater/registry"
 )
 
 const serviceLabel string = "xyz.megpoid.swarm-updater"
 const updateOnlyLabel string = "xyz.megpoid.swarm-updater.update-only"
 const enabledServiceLabel string = "xyz.megpoid.swarm-updater.enable"
+const allowPlatformMismatchLabel string = "xyz.megpoid.swarm-updater.allow-platform-mismatch"
+const rollbackLabel string = "xyz.megpoid.swarm-updater.rollback"
+
+// DefaultConvergeTimeout is used when Swarm.ConvergeTimeout is zero.
+const DefaultConvergeTimeout = 5 * time.Minute
+
+// convergePollInterval is how often the task list is polled while waiting
+// for a service update to converge.
+const convergePollInterval = 2 * time.Second
+
+// defaultMaxParallel is used when Swarm.MaxParallel is zero.
+const defaultMaxParallel = 4
+
+// Outcome describes what happened to a single service during an update
+// sweep.
+type Outcome int
+
+// Possible outcomes of updating a single service, in ServiceResult.Outcome.
+const (
+	OutcomeSkipped Outcome = iota
+	OutcomeAlreadyUpToDate
+	OutcomeUpdated
+	OutcomeRolledBack
+	OutcomeFailed
+)
+
+func (o Outcome) String() string {
+	switch o {
+	case OutcomeSkipped:
+		return "skipped"
+	case OutcomeAlreadyUpToDate:
+		return "already up to date"
+	case OutcomeUpdated:
+		return "updated"
+	case OutcomeRolledBack:
+		return "rolled back"
+	case OutcomeFailed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+// ServiceResult is the outcome of attempting to update a single service.
+type ServiceResult struct {
+	ServiceID   string
+	ServiceName string
+	Outcome     Outcome
+	FromImage   string
+	ToImage     string
+	Err         error
+}
+
+func (r ServiceResult) fail(err error) ServiceResult {
+	r.Outcome = OutcomeFailed
+	r.Err = err
+	return r
+}
+
+// UpdateReport is the structured result of a single UpdateServices sweep,
+// suitable for callers to assert against in tests or serialize for a
+// notification subsystem.
+type UpdateReport struct {
+	Results []ServiceResult
+}
+
+// PinMode controls how a service's image digest gets pinned into its spec.
+type PinMode string
+
+const (
+	// PinModeClient resolves the digest locally via DistributionInspect and
+	// writes a digest-pinned reference into the service spec. This is the
+	// original behavior and the default.
+	PinModeClient PinMode = "client"
+	// PinModeDaemon leaves the image reference tagged and sets
+	// updateOpts.QueryRegistry so the swarm manager resolves and pins the
+	// digest itself, surfacing any failure to do so via response warnings.
+	PinModeDaemon PinMode = "daemon"
+	// PinModeOff disables digest pinning entirely.
+	PinModeOff PinMode = "off"
+)
+
+// unableToPinWarning is the substring moby's manager uses in
+// ServiceUpdateResponse.Warnings when QueryRegistry couldn't pin the digest.
+const unableToPinWarning = "unable to pin"
 
 // Swarm struct to handle all the service operations
 type Swarm struct {
-	client      DockerClient
-	Blacklist   []*regexp.Regexp
-	LabelEnable bool
+	client                DockerClient
+	Blacklist             []*regexp.Regexp
+	LabelEnable           bool
+	AllowPlatformMismatch bool
+	PinMode               PinMode
+	// FailOnPinWarning makes updateService return an error when the daemon
+	// reports it could not pin a digest while in PinModeDaemon.
+	FailOnPinWarning bool
+	// PinFailures counts "unable to pin" warnings returned by the daemon,
+	// for callers that want to expose it as a metric.
+	PinFailures uint64
+	// ConvergeTimeout bounds how long updateService waits for an updated
+	// service to reach its desired replica count before rolling it back.
+	// Defaults to DefaultConvergeTimeout when zero.
+	ConvergeTimeout time.Duration
+	// Registry resolves registry credentials from a config file, consulted
+	// before falling back to RetrieveAuthTokenFromImage. May be nil.
+	Registry *registry.Resolver
+	// MaxParallel bounds how many services UpdateServices updates at once.
+	// Defaults to defaultMaxParallel when zero.
+	MaxParallel int
 }
 
 func (c *Swarm) validService(service swarm.Service) bool {
@@ -87,14 +197,17 @@ func (c *Swarm) serviceList(ctx context.Context) ([]swarm.Service, error) {
 	return services, nil
 }
 
-func (c *Swarm) updateService(ctx context.Context, service swarm.Service) error {
+func (c *Swarm) updateService(ctx context.Context, service swarm.Service) ServiceResult {
+	result := ServiceResult{ServiceID: service.ID, ServiceName: service.Spec.Name}
+
 	image := service.Spec.TaskTemplate.ContainerSpec.Image
+	result.FromImage = image
 	updateOpts := types.ServiceUpdateOptions{}
 
 	// get docker auth
-	encodedAuth, err := c.client.RetrieveAuthTokenFromImage(ctx, image)
+	encodedAuth, err := c.resolveAuth(ctx, image)
 	if err != nil {
-		return errors.Wrap(err, "cannot retrieve auth token from service's image")
+		return result.fail(errors.Wrap(err, "cannot retrieve auth token from service's image"))
 	}
 
 	// do not set auth if is an empty json object
@@ -105,15 +218,56 @@ func (c *Swarm) updateService(ctx context.Context, service swarm.Service) error
 	// remove image hash from name
 	imageName := strings.Split(image, "@sha")[0]
 
-	// fetch a newer image digest
-	service.Spec.TaskTemplate.ContainerSpec.Image, err = c.getImageDigest(ctx, imageName, updateOpts.EncodedRegistryAuth)
-	if err != nil {
-		return errors.Wrap(err, "failed to get new image digest")
-	}
+	switch c.PinMode {
+	case PinModeDaemon:
+		// delegate digest resolution to the swarm manager instead of
+		// pinning it ourselves; leave the image tagged in the spec. Whether
+		// there's actually anything new is only known once the manager
+		// resolves it, so the up-to-date check happens after ServiceUpdate
+		// via the previous/current comparison below instead of here.
+		updateOpts.QueryRegistry = true
+		service.Spec.TaskTemplate.ContainerSpec.Image = imageName
+	case PinModeOff:
+		service.Spec.TaskTemplate.ContainerSpec.Image = imageName
+
+		if image == imageName {
+			log.Debug("Service %s is already up to date", service.Spec.Name)
+			result.Outcome = OutcomeAlreadyUpToDate
+			return result
+		}
+	default:
+		// fetch a newer image digest, pinned to the platforms the service
+		// can actually run on
+		newImage, platforms, err := c.getImageDigest(ctx, service, imageName, updateOpts.EncodedRegistryAuth)
+		if err != nil && c.Registry != nil && isUnauthorized(err) {
+			// the cached credentials may have expired; refresh and retry once
+			if host, hostErr := registry.Host(imageName); hostErr == nil {
+				c.Registry.Invalidate(host)
+			}
 
-	if image == service.Spec.TaskTemplate.ContainerSpec.Image {
-		log.Debug("Service %s is already up to date", service.Spec.Name)
-		return nil
+			if refreshedAuth, refreshErr := c.resolveAuth(ctx, imageName); refreshErr == nil {
+				updateOpts.EncodedRegistryAuth = refreshedAuth
+				newImage, platforms, err = c.getImageDigest(ctx, service, imageName, refreshedAuth)
+			}
+		}
+		if err != nil {
+			return result.fail(errors.Wrap(err, "failed to get new image digest"))
+		}
+
+		service.Spec.TaskTemplate.ContainerSpec.Image = newImage
+
+		if len(platforms) > 0 {
+			if service.Spec.TaskTemplate.Placement == nil {
+				service.Spec.TaskTemplate.Placement = &swarm.Placement{}
+			}
+			service.Spec.TaskTemplate.Placement.Platforms = platforms
+		}
+
+		if image == service.Spec.TaskTemplate.ContainerSpec.Image {
+			log.Debug("Service %s is already up to date", service.Spec.Name)
+			result.Outcome = OutcomeAlreadyUpToDate
+			return result
+		}
 	}
 
 	if strings.ToLower(service.Spec.Labels[updateOnlyLabel]) == "true" {
@@ -125,96 +279,380 @@ func (c *Swarm) updateService(ctx context.Context, service swarm.Service) error
 	log.Debug("Updating service %s...", service.Spec.Name)
 	response, err := c.client.ServiceUpdate(ctx, service.ID, service.Version, service.Spec, updateOpts)
 	if err != nil {
-		return errors.Wrapf(err, "failed to update service %s", service.Spec.Name)
+		return result.fail(errors.Wrapf(err, "failed to update service %s", service.Spec.Name))
 	}
 
-	for _, warning := range response.Warnings {
-		log.Debug("response warning:\n%s", warning)
+	if err := c.checkPinWarnings(service, response.Warnings); err != nil {
+		return result.fail(err)
 	}
 
 	updatedService, _, err := c.client.ServiceInspectWithRaw(ctx, service.ID, types.ServiceInspectOptions{})
 	if err != nil {
-		return errors.Wrapf(err, "cannot inspect service %s to check update status", service.Spec.Name)
+		return result.fail(errors.Wrapf(err, "cannot inspect service %s to check update status", service.Spec.Name))
 	}
 
 	previous := updatedService.PreviousSpec.TaskTemplate.ContainerSpec.Image
 	current := updatedService.Spec.TaskTemplate.ContainerSpec.Image
+	result.ToImage = current
 
-	if previous != current {
-		log.Printf("Service %s updated to %s", service.Spec.Name, current)
-	} else {
+	if previous == current {
 		log.Debug("Service %s is up to date", service.Spec.Name)
+		result.Outcome = OutcomeAlreadyUpToDate
+		return result
+	}
+
+	log.Printf("Service %s updated to %s", service.Spec.Name, current)
+	result.Outcome = OutcomeUpdated
+
+	if strings.ToLower(service.Spec.Labels[rollbackLabel]) == "false" {
+		return result
 	}
 
+	if convergeErr := c.waitForConvergence(ctx, updatedService); convergeErr != nil {
+		if err := c.rollbackService(ctx, service.ID, convergeErr); err != nil {
+			return result.fail(err)
+		}
+		result.Outcome = OutcomeRolledBack
+	}
+
+	return result
+}
+
+// waitForConvergence polls the tasks of a just-updated service until it
+// reaches its replica count or ConvergeTimeout elapses. Global services and
+// services with no replica count configured are not watched.
+func (c *Swarm) waitForConvergence(ctx context.Context, service swarm.Service) error {
+	replicas := replicaCount(service)
+	if replicas == 0 {
+		return nil
+	}
+
+	timeout := c.ConvergeTimeout
+	if timeout == 0 {
+		timeout = DefaultConvergeTimeout
+	}
+
+	deadline := time.Now().Add(timeout)
+
+	for {
+		tasks, err := c.client.TaskList(ctx, types.TaskListOptions{
+			Filters: filters.NewArgs(filters.Arg("service", service.ID)),
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed to list tasks for service %s", service.Spec.Name)
+		}
+
+		healthy, taskErr := countHealthyTasks(tasks, service.Spec.TaskTemplate)
+		if healthy >= replicas {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			if taskErr != "" {
+				return errors.Errorf("service %s did not converge within %s: %s", service.Spec.Name, timeout, taskErr)
+			}
+			return errors.Errorf("service %s did not converge within %s", service.Spec.Name, timeout)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(convergePollInterval):
+		}
+	}
+}
+
+// rollbackService reverts a service to its previous spec after it failed to
+// converge, re-inspecting it first to pick up the version set by the update
+// that's being rolled back.
+func (c *Swarm) rollbackService(ctx context.Context, serviceID string, convergeErr error) error {
+	service, _, err := c.client.ServiceInspectWithRaw(ctx, serviceID, types.ServiceInspectOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "cannot inspect service %s before rollback", serviceID)
+	}
+
+	log.Printf("Service %s failed to converge (%s), rolling back", service.Spec.Name, convergeErr)
+
+	updateOpts := types.ServiceUpdateOptions{Rollback: "previous"}
+	if _, err := c.client.ServiceUpdate(ctx, service.ID, service.Version, service.Spec, updateOpts); err != nil {
+		return errors.Wrapf(err, "failed to roll back service %s", service.Spec.Name)
+	}
+
+	log.Printf("Service %s rolled back to its previous spec", service.Spec.Name)
+
 	return nil
 }
 
-// UpdateServices updates all the services from a Docker swarm
-func (c *Swarm) UpdateServices(ctx context.Context) error {
+// replicaCount returns the configured replica count of a replicated
+// service, or 0 for global services and services without a count set.
+func replicaCount(service swarm.Service) int {
+	if service.Spec.Mode.Replicated != nil && service.Spec.Mode.Replicated.Replicas != nil {
+		return int(*service.Spec.Mode.Replicated.Replicas)
+	}
+
+	return 0
+}
+
+// countHealthyTasks counts the tasks of a service that are running the
+// given task template and have reached the running state, returning the
+// last non-empty task error seen so it can be surfaced if convergence times
+// out.
+func countHealthyTasks(tasks []swarm.Task, template swarm.TaskSpec) (int, string) {
+	var healthy int
+	var lastErr string
+
+	for _, task := range tasks {
+		if task.Spec.ContainerSpec == nil || template.ContainerSpec == nil {
+			continue
+		}
+
+		if task.Spec.ContainerSpec.Image != template.ContainerSpec.Image {
+			continue
+		}
+
+		if task.DesiredState == swarm.TaskStateRunning && task.Status.State == swarm.TaskStateRunning {
+			healthy++
+		}
+
+		if task.Status.Err != "" {
+			lastErr = task.Status.Err
+		}
+	}
+
+	return healthy, lastErr
+}
+
+// UpdateServices updates all the services from a Docker swarm, dispatching
+// them to a bounded worker pool (sized by MaxParallel) instead of updating
+// them strictly serially. The updater's own service (identified by
+// serviceLabel) is deferred until every worker has settled and is updated
+// on the calling goroutine, preserving the invariant that the updater never
+// races its own replacement.
+func (c *Swarm) UpdateServices(ctx context.Context) (*UpdateReport, error) {
 	services, err := c.serviceList(ctx)
 	if err != nil {
-		return errors.Wrap(err, "failed to get service list")
+		return nil, errors.Wrap(err, "failed to get service list")
 	}
 
-	var serviceID string
+	var selfService swarm.Service
+	haveSelf := false
+	jobs := make([]swarm.Service, 0, len(services))
+	report := &UpdateReport{}
 
 	for _, service := range services {
-		if c.validService(service) {
+		if !c.validService(service) {
+			log.Debug("Service %s was ignored by blacklist or missing label", service.Spec.Name)
+			report.Results = append(report.Results, ServiceResult{
+				ServiceID:   service.ID,
+				ServiceName: service.Spec.Name,
+				Outcome:     OutcomeSkipped,
+			})
+			continue
+		}
 
-			// try to identify this service
-			if _, ok := service.Spec.Annotations.Labels[serviceLabel]; ok {
-				serviceID = service.ID
-				continue
-			}
+		// try to identify this service
+		if _, ok := service.Spec.Annotations.Labels[serviceLabel]; ok {
+			selfService = service
+			haveSelf = true
+			continue
+		}
+
+		jobs = append(jobs, service)
+	}
 
-			if err = c.updateService(ctx, service); err != nil {
-				if ctx.Err() == context.Canceled {
-					log.Printf("Service update canceled")
-					break
-				}
-				log.Printf("Cannot update service %s: %s", service.Spec.Name, err.Error())
+	maxParallel := c.MaxParallel
+	if maxParallel <= 0 {
+		maxParallel = defaultMaxParallel
+	}
+
+	jobResults := make([]ServiceResult, len(jobs))
+	sem := make(chan struct{}, maxParallel)
+	var wg sync.WaitGroup
+
+	for i, service := range jobs {
+		if ctx.Err() != nil {
+			// context is already done: skip the rest of the queue instead
+			// of dispatching workers that would just be canceled
+			jobResults[i] = ServiceResult{
+				ServiceID:   service.ID,
+				ServiceName: service.Spec.Name,
+				Outcome:     OutcomeSkipped,
+				Err:         ctx.Err(),
 			}
-		} else {
-			log.Debug("Service %s was ignored by blacklist or missing label", service.Spec.Name)
+			continue
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+
+		go func(i int, service swarm.Service) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			jobResults[i] = c.updateService(ctx, service)
+		}(i, service)
+	}
+
+	wg.Wait()
+	report.Results = append(report.Results, jobResults...)
+
+	for _, result := range report.Results {
+		if result.Outcome == OutcomeFailed {
+			log.Printf("Cannot update service %s: %s", result.ServiceName, result.Err)
 		}
 	}
 
-	if serviceID != "" {
+	if haveSelf {
 		// refresh service
-		service, _, err := c.client.ServiceInspectWithRaw(ctx, serviceID, types.ServiceInspectOptions{})
+		service, _, err := c.client.ServiceInspectWithRaw(ctx, selfService.ID, types.ServiceInspectOptions{})
 		if err != nil {
-			return errors.Wrapf(err, "cannot inspect the service %s", serviceID)
+			return report, errors.Wrapf(err, "cannot inspect the service %s", selfService.ID)
 		}
 
-		err = c.updateService(ctx, service)
-		if err != nil {
-			return errors.Wrapf(err, "failed to update the service %s", serviceID)
+		result := c.updateService(ctx, service)
+		report.Results = append(report.Results, result)
+		if result.Outcome == OutcomeFailed {
+			return report, errors.Wrapf(result.Err, "failed to update the service %s", selfService.ID)
+		}
+	}
+
+	return report, nil
+}
+
+// resolveAuth resolves the registry auth to use for image, consulting the
+// configured registry.Resolver first and falling back to the docker CLI's
+// own config (the previous, and still default, behavior).
+func (c *Swarm) resolveAuth(ctx context.Context, image string) (string, error) {
+	if c.Registry != nil {
+		encodedAuth, err := c.Registry.AuthForImage(ctx, image)
+		if err == nil {
+			return encodedAuth, nil
+		}
+		log.Debug("registry resolver: %s, falling back to docker client config", err)
+	}
+
+	return c.client.RetrieveAuthTokenFromImage(ctx, image)
+}
+
+// isUnauthorized reports whether err is a registry 401, the signal to
+// refresh cached credentials and retry. It relies on errdefs's typed error
+// classification rather than sniffing err.Error(), so it isn't fooled by an
+// unrelated error whose text happens to mention "unauthorized".
+func isUnauthorized(err error) bool {
+	return errdefs.IsUnauthorized(err)
+}
+
+// checkPinWarnings inspects the warnings returned alongside a service
+// update. Warnings reporting that the daemon couldn't pin the image digest
+// (PinModeDaemon) are promoted to first-class output instead of being
+// logged at debug level, and counted in PinFailures; everything else is
+// logged as before.
+func (c *Swarm) checkPinWarnings(service swarm.Service, warnings []string) error {
+	var pinFailed bool
+
+	for _, warning := range warnings {
+		if strings.Contains(strings.ToLower(warning), unableToPinWarning) {
+			atomic.AddUint64(&c.PinFailures, 1)
+			log.Printf("Service %s: %s", service.Spec.Name, warning)
+			pinFailed = true
+		} else {
+			log.Debug("response warning:\n%s", warning)
 		}
 	}
 
+	if pinFailed && c.FailOnPinWarning {
+		return errors.Errorf("service %s: daemon reported it could not pin the image digest", service.Spec.Name)
+	}
+
 	return nil
 }
 
-func (c *Swarm) getImageDigest(ctx context.Context, image, encodedAuth string) (string, error) {
+// getImageDigest resolves image to a digest-pinned reference. When the
+// registry returns a manifest list, the declared platforms are intersected
+// with the service's placement constraints (or the local daemon's platform
+// if none are declared) the same way `docker service create`'s
+// imageDigestAndPlatforms does, and the matching platforms are returned so
+// the caller can pin them back onto the service's placement constraints.
+func (c *Swarm) getImageDigest(ctx context.Context, service swarm.Service, image, encodedAuth string) (string, []swarm.Platform, error) {
 	namedRef, err := reference.ParseNormalizedNamed(image)
 	if err != nil {
-		return "", errors.Wrap(err, "failed to parse image name")
+		return "", nil, errors.Wrap(err, "failed to parse image name")
 	}
 
 	if _, isCanonical := namedRef.(reference.Canonical); isCanonical {
-		return "", errors.New("the image name already have a digest")
+		return "", nil, errors.New("the image name already have a digest")
 	}
 
 	distributionInspect, err := c.client.DistributionInspect(ctx, image, encodedAuth)
 	if err != nil {
-		return "", errors.Wrap(err, "failed to inspect image")
+		return "", nil, errors.Wrap(err, "failed to inspect image")
+	}
+
+	platforms, err := c.matchPlatforms(ctx, service, distributionInspect.Platforms)
+	if err != nil {
+		return "", nil, err
 	}
 
 	// ensure that image gets a default tag if none is provided
 	img, err := reference.WithDigest(namedRef, distributionInspect.Descriptor.Digest)
 	if err != nil {
-		return "", errors.Wrap(err, "the image name has an invalid format")
+		return "", nil, errors.Wrap(err, "the image name has an invalid format")
+	}
+
+	return reference.FamiliarString(img), platforms, nil
+}
+
+// matchPlatforms intersects the platforms advertised by a manifest list with
+// the platforms the service is constrained to run on, defaulting to the
+// local daemon's platform when the service declares none. It returns the
+// matching platform constraints to pin onto the service spec, or an error
+// if none match and platform mismatches aren't allowed for this service.
+func (c *Swarm) matchPlatforms(ctx context.Context, service swarm.Service, manifestPlatforms []ocispec.Platform) ([]swarm.Platform, error) {
+	if len(manifestPlatforms) == 0 {
+		// not a manifest list/image index, nothing to pin
+		return nil, nil
+	}
+
+	var declared []swarm.Platform
+	if service.Spec.TaskTemplate.Placement != nil {
+		declared = service.Spec.TaskTemplate.Placement.Platforms
+	}
+	if len(declared) == 0 {
+		local, err := c.localPlatform(ctx)
+		if err != nil {
+			return nil, err
+		}
+		declared = []swarm.Platform{local}
+	}
+
+	var matched []swarm.Platform
+	for _, d := range declared {
+		for _, p := range manifestPlatforms {
+			if strings.EqualFold(p.OS, d.OS) && strings.EqualFold(p.Architecture, d.Architecture) {
+				matched = append(matched, d)
+				break
+			}
+		}
+	}
+
+	if len(matched) == 0 {
+		if c.AllowPlatformMismatch || strings.ToLower(service.Spec.Labels[allowPlatformMismatchLabel]) == "true" {
+			log.Debug("Service %s: no platform in the manifest list matches its placement constraints, pinning the index digest anyway", service.Spec.Name)
+			return nil, nil
+		}
+		return nil, errors.Errorf("no platform in the manifest list satisfies the placement constraints of service %s", service.Spec.Name)
+	}
+
+	return matched, nil
+}
+
+// localPlatform returns the platform of the Docker daemon the updater is
+// talking to, used as the default placement constraint for services that
+// don't declare their own.
+func (c *Swarm) localPlatform(ctx context.Context) (swarm.Platform, error) {
+	info, err := c.client.Info(ctx)
+	if err != nil {
+		return swarm.Platform{}, errors.Wrap(err, "failed to query docker daemon info")
 	}
 
-	return reference.FamiliarString(img), nil
+	return swarm.Platform{Architecture: info.Architecture, OS: info.OSType}, nil
 }
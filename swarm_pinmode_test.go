@@ -0,0 +1,115 @@
+/*
+Copyright 2018 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/docker/docker/api/types/swarm"
+)
+
+func baseService(image string) swarm.Service {
+	return swarm.Service{
+		ID: "service-id",
+		Spec: swarm.ServiceSpec{
+			Annotations:  swarm.Annotations{Name: "svc"},
+			TaskTemplate: swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{Image: image}},
+		},
+	}
+}
+
+func TestCheckPinWarningsCounts(t *testing.T) {
+	c := &Swarm{}
+
+	err := c.checkPinWarnings(baseService("nginx:latest"), []string{"unable to pin image digest: timeout", "some other warning"})
+	if err != nil {
+		t.Fatalf("checkPinWarnings() error: %s", err)
+	}
+
+	if c.PinFailures != 1 {
+		t.Errorf("PinFailures = %d, want 1", c.PinFailures)
+	}
+}
+
+func TestCheckPinWarningsFailOnPinWarning(t *testing.T) {
+	c := &Swarm{FailOnPinWarning: true}
+
+	err := c.checkPinWarnings(baseService("nginx:latest"), []string{"unable to pin image digest: timeout"})
+	if err == nil {
+		t.Fatal("checkPinWarnings() expected an error when FailOnPinWarning is set")
+	}
+}
+
+func TestUpdateServicePinModeOffSkipsWhenUnchanged(t *testing.T) {
+	fake := &fakeDockerClient{}
+	c := &Swarm{client: fake, PinMode: PinModeOff}
+
+	result := c.updateService(context.Background(), baseService("nginx:1.0"))
+
+	if result.Outcome != OutcomeAlreadyUpToDate {
+		t.Errorf("Outcome = %v, want OutcomeAlreadyUpToDate", result.Outcome)
+	}
+
+	if fake.updateCalls() != 0 {
+		t.Errorf("ServiceUpdate called %d times, want 0", fake.updateCalls())
+	}
+}
+
+func TestUpdateServicePinModeOffUpdatesWhenChanged(t *testing.T) {
+	fake := &fakeDockerClient{
+		serviceInspect: swarm.Service{
+			Spec: swarm.ServiceSpec{
+				TaskTemplate: swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{Image: "nginx:1.1"}},
+			},
+			PreviousSpec: &swarm.ServiceSpec{
+				TaskTemplate: swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{Image: "nginx:1.0@sha256:abc"}},
+			},
+		},
+	}
+	c := &Swarm{client: fake, PinMode: PinModeOff}
+
+	result := c.updateService(context.Background(), baseService("nginx:1.0@sha256:abc"))
+
+	if result.Outcome != OutcomeUpdated {
+		t.Errorf("Outcome = %v, want OutcomeUpdated", result.Outcome)
+	}
+
+	if fake.updateCalls() != 1 {
+		t.Errorf("ServiceUpdate called %d times, want 1", fake.updateCalls())
+	}
+}
+
+func TestUpdateServicePinModeDaemonSetsQueryRegistry(t *testing.T) {
+	fake := &fakeDockerClient{
+		serviceInspect: swarm.Service{
+			Spec: swarm.ServiceSpec{
+				TaskTemplate: swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{Image: "nginx:1.0"}},
+			},
+			PreviousSpec: &swarm.ServiceSpec{
+				TaskTemplate: swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{Image: "nginx:1.0"}},
+			},
+		},
+	}
+	c := &Swarm{client: fake, PinMode: PinModeDaemon}
+
+	c.updateService(context.Background(), baseService("nginx:1.0"))
+
+	if !fake.lastOpts().QueryRegistry {
+		t.Error("ServiceUpdate called without QueryRegistry set in PinModeDaemon")
+	}
+}
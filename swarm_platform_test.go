@@ -0,0 +1,135 @@
+/*
+Copyright 2018 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestMatchPlatformsNoManifestList(t *testing.T) {
+	c := &Swarm{client: &fakeDockerClient{}}
+
+	platforms, err := c.matchPlatforms(context.Background(), swarm.Service{}, nil)
+	if err != nil {
+		t.Fatalf("matchPlatforms() error: %s", err)
+	}
+	if platforms != nil {
+		t.Errorf("matchPlatforms() = %v, want nil", platforms)
+	}
+}
+
+func TestMatchPlatformsUsesDeclaredPlacement(t *testing.T) {
+	c := &Swarm{client: &fakeDockerClient{}}
+
+	service := swarm.Service{Spec: swarm.ServiceSpec{TaskTemplate: swarm.TaskSpec{
+		Placement: &swarm.Placement{Platforms: []swarm.Platform{{OS: "linux", Architecture: "arm64"}}},
+	}}}
+
+	manifest := []ocispec.Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm64"},
+	}
+
+	platforms, err := c.matchPlatforms(context.Background(), service, manifest)
+	if err != nil {
+		t.Fatalf("matchPlatforms() error: %s", err)
+	}
+	if len(platforms) != 1 || platforms[0].Architecture != "arm64" {
+		t.Errorf("matchPlatforms() = %v, want [{linux arm64}]", platforms)
+	}
+}
+
+func TestMatchPlatformsDefaultsToLocalPlatform(t *testing.T) {
+	c := &Swarm{client: &fakeDockerClient{info: types.Info{Architecture: "x86_64", OSType: "linux"}}}
+
+	manifest := []ocispec.Platform{{OS: "linux", Architecture: "x86_64"}}
+
+	platforms, err := c.matchPlatforms(context.Background(), swarm.Service{}, manifest)
+	if err != nil {
+		t.Fatalf("matchPlatforms() error: %s", err)
+	}
+	if len(platforms) != 1 || platforms[0].OS != "linux" {
+		t.Errorf("matchPlatforms() = %v, want [{linux x86_64}]", platforms)
+	}
+}
+
+func TestMatchPlatformsMismatchDisallowed(t *testing.T) {
+	c := &Swarm{client: &fakeDockerClient{info: types.Info{Architecture: "x86_64", OSType: "linux"}}}
+
+	manifest := []ocispec.Platform{{OS: "windows", Architecture: "amd64"}}
+
+	if _, err := c.matchPlatforms(context.Background(), swarm.Service{}, manifest); err == nil {
+		t.Fatal("matchPlatforms() expected an error when no platform matches")
+	}
+}
+
+func TestMatchPlatformsMismatchAllowedBySwarm(t *testing.T) {
+	c := &Swarm{
+		client:                &fakeDockerClient{info: types.Info{Architecture: "x86_64", OSType: "linux"}},
+		AllowPlatformMismatch: true,
+	}
+
+	manifest := []ocispec.Platform{{OS: "windows", Architecture: "amd64"}}
+
+	platforms, err := c.matchPlatforms(context.Background(), swarm.Service{}, manifest)
+	if err != nil {
+		t.Fatalf("matchPlatforms() error: %s", err)
+	}
+	if platforms != nil {
+		t.Errorf("matchPlatforms() = %v, want nil", platforms)
+	}
+}
+
+func TestMatchPlatformsMismatchAllowedByLabel(t *testing.T) {
+	c := &Swarm{client: &fakeDockerClient{info: types.Info{Architecture: "x86_64", OSType: "linux"}}}
+
+	service := swarm.Service{Spec: swarm.ServiceSpec{
+		Annotations: swarm.Annotations{Labels: map[string]string{allowPlatformMismatchLabel: "true"}},
+	}}
+
+	manifest := []ocispec.Platform{{OS: "windows", Architecture: "amd64"}}
+
+	if _, err := c.matchPlatforms(context.Background(), service, manifest); err != nil {
+		t.Fatalf("matchPlatforms() error: %s", err)
+	}
+}
+
+func TestLocalPlatform(t *testing.T) {
+	c := &Swarm{client: &fakeDockerClient{info: types.Info{Architecture: "arm64", OSType: "linux"}}}
+
+	platform, err := c.localPlatform(context.Background())
+	if err != nil {
+		t.Fatalf("localPlatform() error: %s", err)
+	}
+	if platform.Architecture != "arm64" || platform.OS != "linux" {
+		t.Errorf("localPlatform() = %+v, want {arm64 linux}", platform)
+	}
+}
+
+func TestLocalPlatformError(t *testing.T) {
+	c := &Swarm{client: &fakeDockerClient{infoErr: errors.New("daemon unreachable")}}
+
+	if _, err := c.localPlatform(context.Background()); err == nil {
+		t.Fatal("localPlatform() expected an error")
+	}
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2018 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/docker/docker/api/types/swarm"
+)
+
+func replicas(n uint64) *uint64 {
+	return &n
+}
+
+func TestReplicaCount(t *testing.T) {
+	cases := []struct {
+		name    string
+		service swarm.Service
+		want    int
+	}{
+		{
+			name: "replicated with count",
+			service: swarm.Service{Spec: swarm.ServiceSpec{
+				Mode: swarm.ServiceMode{Replicated: &swarm.ReplicatedService{Replicas: replicas(3)}},
+			}},
+			want: 3,
+		},
+		{
+			name: "replicated without count",
+			service: swarm.Service{Spec: swarm.ServiceSpec{
+				Mode: swarm.ServiceMode{Replicated: &swarm.ReplicatedService{}},
+			}},
+			want: 0,
+		},
+		{
+			name: "global",
+			service: swarm.Service{Spec: swarm.ServiceSpec{
+				Mode: swarm.ServiceMode{Global: &swarm.GlobalService{}},
+			}},
+			want: 0,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := replicaCount(tc.service); got != tc.want {
+				t.Errorf("replicaCount() = %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCountHealthyTasks(t *testing.T) {
+	template := swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{Image: "nginx:latest"}}
+
+	tasks := []swarm.Task{
+		{
+			// matches the new template and is running: healthy
+			Spec:         swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{Image: "nginx:latest"}},
+			DesiredState: swarm.TaskStateRunning,
+			Status:       swarm.TaskStatus{State: swarm.TaskStateRunning},
+		},
+		{
+			// matches the new template but failed: counted as the last error
+			Spec:         swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{Image: "nginx:latest"}},
+			DesiredState: swarm.TaskStateRunning,
+			Status:       swarm.TaskStatus{State: swarm.TaskStateFailed, Err: "task: non-zero exit (137)"},
+		},
+		{
+			// still running the previous image: ignored
+			Spec:         swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{Image: "nginx:1.0"}},
+			DesiredState: swarm.TaskStateRunning,
+			Status:       swarm.TaskStatus{State: swarm.TaskStateRunning},
+		},
+	}
+
+	healthy, lastErr := countHealthyTasks(tasks, template)
+
+	if healthy != 1 {
+		t.Errorf("countHealthyTasks() healthy = %d, want 1", healthy)
+	}
+
+	if lastErr != "task: non-zero exit (137)" {
+		t.Errorf("countHealthyTasks() lastErr = %q, want %q", lastErr, "task: non-zero exit (137)")
+	}
+}
+
+func TestCountHealthyTasksNoMatch(t *testing.T) {
+	template := swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{Image: "nginx:latest"}}
+
+	healthy, lastErr := countHealthyTasks(nil, template)
+
+	if healthy != 0 {
+		t.Errorf("countHealthyTasks() healthy = %d, want 0", healthy)
+	}
+
+	if lastErr != "" {
+		t.Errorf("countHealthyTasks() lastErr = %q, want empty", lastErr)
+	}
+}
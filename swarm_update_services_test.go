@@ -0,0 +1,184 @@
+/*
+Copyright 2018 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"regexp"
+	"testing"
+
+	"github.com/docker/docker/api/types/swarm"
+)
+
+func serviceWithName(id, name, image string) swarm.Service {
+	return swarm.Service{
+		ID: id,
+		Spec: swarm.ServiceSpec{
+			Annotations:  swarm.Annotations{Name: name},
+			TaskTemplate: swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{Image: image}},
+		},
+	}
+}
+
+func selfService(id, name, image string) swarm.Service {
+	svc := serviceWithName(id, name, image)
+	svc.Spec.Annotations.Labels = map[string]string{serviceLabel: ""}
+	return svc
+}
+
+func TestUpdateServicesRecordsPolicySkips(t *testing.T) {
+	fake := &fakeDockerClient{
+		serviceList: []swarm.Service{
+			serviceWithName("blacklisted", "ignored-service", "nginx:1.0"),
+		},
+	}
+
+	c := &Swarm{
+		client:    fake,
+		PinMode:   PinModeOff,
+		Blacklist: []*regexp.Regexp{regexp.MustCompile("^ignored-")},
+	}
+
+	report, err := c.UpdateServices(context.Background())
+	if err != nil {
+		t.Fatalf("UpdateServices() error: %s", err)
+	}
+
+	if len(report.Results) != 1 {
+		t.Fatalf("len(report.Results) = %d, want 1", len(report.Results))
+	}
+
+	if report.Results[0].Outcome != OutcomeSkipped {
+		t.Errorf("Outcome = %v, want OutcomeSkipped", report.Results[0].Outcome)
+	}
+
+	if fake.updateCalls() != 0 {
+		t.Errorf("ServiceUpdate called %d times, want 0", fake.updateCalls())
+	}
+}
+
+func TestUpdateServicesDefersSelfServiceToLast(t *testing.T) {
+	fake := &fakeDockerClient{
+		serviceList: []swarm.Service{
+			selfService("self", "swarm-updater", "nginx:1.1"),
+			serviceWithName("unchanged", "app-unchanged", "nginx:1.0"),
+			serviceWithName("changed", "app-changed", "nginx:1.0@sha256:abc"),
+		},
+		serviceInspect: swarm.Service{
+			ID: "self",
+			Spec: swarm.ServiceSpec{
+				Annotations:  swarm.Annotations{Name: "swarm-updater"},
+				TaskTemplate: swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{Image: "nginx:1.1"}},
+			},
+			PreviousSpec: &swarm.ServiceSpec{
+				TaskTemplate: swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{Image: "nginx:1.0"}},
+			},
+		},
+	}
+
+	c := &Swarm{client: fake, PinMode: PinModeOff}
+
+	report, err := c.UpdateServices(context.Background())
+	if err != nil {
+		t.Fatalf("UpdateServices() error: %s", err)
+	}
+
+	if len(report.Results) != 3 {
+		t.Fatalf("len(report.Results) = %d, want 3", len(report.Results))
+	}
+
+	last := report.Results[len(report.Results)-1]
+	if last.ServiceID != "self" {
+		t.Errorf("last result ServiceID = %q, want %q (the updater's own service)", last.ServiceID, "self")
+	}
+
+	var sawUnchanged, sawChanged bool
+	for _, result := range report.Results[:len(report.Results)-1] {
+		switch result.ServiceID {
+		case "unchanged":
+			sawUnchanged = true
+			if result.Outcome != OutcomeAlreadyUpToDate {
+				t.Errorf("unchanged service Outcome = %v, want OutcomeAlreadyUpToDate", result.Outcome)
+			}
+		case "changed":
+			sawChanged = true
+			if result.Outcome != OutcomeUpdated {
+				t.Errorf("changed service Outcome = %v, want OutcomeUpdated", result.Outcome)
+			}
+		}
+	}
+
+	if !sawUnchanged || !sawChanged {
+		t.Errorf("missing expected job results: sawUnchanged=%v sawChanged=%v", sawUnchanged, sawChanged)
+	}
+}
+
+func TestUpdateServicesContextCanceled(t *testing.T) {
+	fake := &fakeDockerClient{
+		serviceList: []swarm.Service{
+			serviceWithName("a", "app-a", "nginx:1.0@sha256:abc"),
+			serviceWithName("b", "app-b", "nginx:1.0@sha256:abc"),
+		},
+	}
+
+	c := &Swarm{client: fake, PinMode: PinModeOff}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	report, err := c.UpdateServices(ctx)
+	if err != nil {
+		t.Fatalf("UpdateServices() error: %s", err)
+	}
+
+	for _, result := range report.Results {
+		if result.Outcome != OutcomeSkipped {
+			t.Errorf("service %s Outcome = %v, want OutcomeSkipped", result.ServiceID, result.Outcome)
+		}
+	}
+
+	if fake.updateCalls() != 0 {
+		t.Errorf("ServiceUpdate called %d times, want 0", fake.updateCalls())
+	}
+}
+
+func TestUpdateServicesMaxParallelOneProcessesAllServices(t *testing.T) {
+	fake := &fakeDockerClient{
+		serviceList: []swarm.Service{
+			serviceWithName("a", "app-a", "nginx:1.0"),
+			serviceWithName("b", "app-b", "nginx:1.0"),
+			serviceWithName("c", "app-c", "nginx:1.0"),
+		},
+	}
+
+	c := &Swarm{client: fake, PinMode: PinModeOff, MaxParallel: 1}
+
+	report, err := c.UpdateServices(context.Background())
+	if err != nil {
+		t.Fatalf("UpdateServices() error: %s", err)
+	}
+
+	if len(report.Results) != 3 {
+		t.Fatalf("len(report.Results) = %d, want 3", len(report.Results))
+	}
+
+	for _, result := range report.Results {
+		if result.Outcome != OutcomeAlreadyUpToDate {
+			t.Errorf("service %s Outcome = %v, want OutcomeAlreadyUpToDate", result.ServiceID, result.Outcome)
+		}
+	}
+}